@@ -0,0 +1,472 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+// Package block contains common functionality for interacting with TSDB blocks
+// in the context of Thanos.
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+const (
+	// MetaFilename is the known JSON filename for meta information.
+	MetaFilename = "meta.json"
+	// IndexFilename is the known index file for block index.
+	IndexFilename = "index"
+	// IndexCacheFilename is the canonical name for index cache file.
+	IndexCacheFilename = "index.cache.json"
+	// ChunksDirname is the known dir name for chunks with compressed fields.
+	ChunksDirname = "chunks"
+
+	// DebugMetas is a directory for debug meta files that happen in the past. Useful for debugging.
+	DebugMetas = "debug/metas"
+
+	// tmpForCreationSuffix is appended to a block ID to obtain the staging prefix an in-flight Upload writes to.
+	tmpForCreationSuffix = ".tmp-for-creation"
+
+	// tmpForDeletionSuffix is appended to a block ID to obtain the prefix a block is renamed to while Delete is
+	// purging it.
+	tmpForDeletionSuffix = ".tmp-for-deletion"
+
+	// deletionInProgressMarkerFilename marks a block as being deleted, in place of a rename, on backends that
+	// can't copy objects.
+	deletionInProgressMarkerFilename = "deletion-in-progress"
+
+	// CorruptMetaPrefix is the prefix blocks with an unparsable meta.json are moved under by
+	// QuarantineCorruptMeta, for offline inspection.
+	CorruptMetaPrefix = "corrupt"
+)
+
+// IsBlockDir returns true if the given directory name (or path, the last element is used) is a valid ULID and
+// hence a block directory.
+func IsBlockDir(path string) (id ulid.ULID, ok bool) {
+	id, err := ulid.Parse(filepath.Base(path))
+	return id, err == nil
+}
+
+// Upload uploads a TSDB block to the object storage. It verifies basic
+// properties of the block before starting the upload.
+//
+// On a bucket that can copy objects server-side, chunks and the index are staged under a `<ulid>.tmp-for-creation/`
+// prefix first and only committed into the canonical `<ulid>/` prefix once both have landed, so listers never see
+// a partial block. Other buckets upload directly to the canonical prefix; meta.json is uploaded last either way,
+// so its presence at <ulid>/ is always proof the rest of the block landed too.
+func Upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, blockDir string) error {
+	df, err := os.Stat(blockDir)
+	if err != nil {
+		return errors.Wrap(err, "stat dir")
+	}
+	if !df.IsDir() {
+		return errors.Errorf("%s is not a directory", blockDir)
+	}
+
+	// Verify dir.
+	id, err := ulid.Parse(filepath.Base(blockDir))
+	if err != nil {
+		return errors.Wrap(err, "not a block dir")
+	}
+
+	meta, err := metadata.Read(blockDir)
+	if err != nil {
+		return errors.Wrap(err, "read meta")
+	}
+
+	if len(meta.Thanos.Labels) == 0 {
+		return errors.New("empty external labels are not allowed for Thanos block.")
+	}
+
+	// A previous upload attempt for this ID may have landed a corrupt meta.json at the canonical prefix (e.g. a
+	// write truncated right at the commit step). Quarantine it before retrying, rather than letting this upload
+	// silently overwrite evidence of the earlier corruption.
+	if _, err := QuarantineCorruptMeta(ctx, logger, bkt, id, nil); err != nil {
+		return errors.Wrap(err, "quarantine corrupt meta.json before upload")
+	}
+
+	finalDir := id.String()
+
+	if _, hasCopy := bkt.(copier); hasCopy {
+		if err := uploadViaStagingPrefix(ctx, logger, bkt, blockDir, finalDir); err != nil {
+			return err
+		}
+	} else {
+		if err := objstore.UploadDir(ctx, logger, bkt, path.Join(blockDir, ChunksDirname), path.Join(finalDir, ChunksDirname)); err != nil {
+			return errors.Wrap(err, "upload chunks")
+		}
+		if err := objstore.UploadFile(ctx, logger, bkt, path.Join(blockDir, IndexFilename), path.Join(finalDir, IndexFilename)); err != nil {
+			return errors.Wrap(err, "upload index")
+		}
+	}
+
+	// meta.json is uploaded directly to the canonical prefix and always last: components that discover blocks by
+	// listing the bucket treat the existence of a valid meta.json at <ulid>/ as proof that the block is complete.
+	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(blockDir, MetaFilename), path.Join(finalDir, MetaFilename)); err != nil {
+		return errors.Wrap(err, "upload meta file")
+	}
+
+	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(blockDir, MetaFilename), path.Join(DebugMetas, fmt.Sprintf("%s.json", id))); err != nil {
+		return errors.Wrap(err, "upload debug meta file")
+	}
+
+	return nil
+}
+
+// uploadViaStagingPrefix uploads chunks and the index under a `<finalDir>.tmp-for-creation/` prefix and commits
+// them into finalDir via a server-side copy, for buckets that implement copier.
+func uploadViaStagingPrefix(ctx context.Context, logger log.Logger, bkt objstore.Bucket, blockDir, finalDir string) error {
+	stagingDir := finalDir + tmpForCreationSuffix
+
+	if err := objstore.UploadDir(ctx, logger, bkt, path.Join(blockDir, ChunksDirname), path.Join(stagingDir, ChunksDirname)); err != nil {
+		return errors.Wrap(err, "upload chunks")
+	}
+	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(blockDir, IndexFilename), path.Join(stagingDir, IndexFilename)); err != nil {
+		return errors.Wrap(err, "upload index")
+	}
+
+	// Chunks and index are staged and verified complete. Commit them to the canonical prefix via server-side copy.
+	if err := commitPrefix(ctx, bkt, stagingDir, finalDir); err != nil {
+		return errors.Wrap(err, "commit staged block to canonical prefix")
+	}
+
+	// Best effort: the block is already complete and visible at this point, so a failure here just leaves the
+	// staging prefix around for CleanupPartialUploads to reclaim later.
+	if err := deletePrefix(ctx, bkt, stagingDir); err != nil {
+		level.Warn(logger).Log("msg", "failed to remove staging prefix after commit; it will be removed by CleanupPartialUploads", "dir", stagingDir, "err", err)
+	}
+
+	return nil
+}
+
+// copier is implemented by bucket backends that can relocate an object without the caller downloading and
+// re-uploading its content.
+type copier interface {
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// commitPrefix makes every object found under srcPrefix also available under dstPrefix, preferring a server-side
+// copy when the bucket implementation exposes one.
+func commitPrefix(ctx context.Context, bkt objstore.Bucket, srcPrefix, dstPrefix string) error {
+	c, hasCopy := bkt.(copier)
+
+	return bkt.Iter(ctx, srcPrefix+"/", func(name string) error {
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			return commitPrefix(ctx, bkt, strings.TrimSuffix(name, objstore.DirDelim), path.Join(dstPrefix, filepath.Base(strings.TrimSuffix(name, objstore.DirDelim))))
+		}
+
+		dst := path.Join(dstPrefix, strings.TrimPrefix(name, srcPrefix+"/"))
+		if hasCopy {
+			return c.Copy(ctx, name, dst)
+		}
+
+		rc, err := bkt.Get(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "get %s", name)
+		}
+		defer rc.Close()
+
+		return bkt.Upload(ctx, dst, rc)
+	}, objstore.WithRecursiveIter)
+}
+
+// deletePrefix removes every object found under prefix, in no particular order. Use this for prefixes that are
+// already unreachable as a canonical block (a tmp-for-creation staging prefix, a tmp-for-deletion or corrupt/
+// quarantine prefix): nothing treats meta.json there as proof the block is live, so the deletion order doesn't
+// matter. For a prefix a fetcher might still be reading as the canonical block, use deleteCanonicalPrefix instead.
+func deletePrefix(ctx context.Context, bkt objstore.Bucket, prefix string) error {
+	return bkt.Iter(ctx, prefix+"/", func(name string) error {
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			return deletePrefix(ctx, bkt, strings.TrimSuffix(name, objstore.DirDelim))
+		}
+		return bkt.Delete(ctx, name)
+	}, objstore.WithRecursiveIter)
+}
+
+// deleteCanonicalPrefix removes a block's files directly from its canonical <ulid>/ prefix — the prefix fetchers
+// treat as the live, discoverable block. meta.json is deleted first, before anything else: that way a process
+// dying partway through always leaves behind either a complete block (meta.json plus all data, untouched so far)
+// or no block at all (meta.json already gone, so fetchers skip it and a retried purge can clean up the rest) —
+// never a meta.json that looks valid while pointing at data that is partially missing.
+func deleteCanonicalPrefix(ctx context.Context, bkt objstore.Bucket, prefix string) error {
+	metaFile := path.Join(prefix, MetaFilename)
+	ok, err := bkt.Exists(ctx, metaFile)
+	if err != nil {
+		return errors.Wrap(err, "meta.json exists")
+	}
+	if ok {
+		if err := bkt.Delete(ctx, metaFile); err != nil {
+			return errors.Wrap(err, "delete meta.json")
+		}
+	}
+	return deletePrefix(ctx, bkt, prefix)
+}
+
+// CleanupPartialUploads removes stale `<ulid>.tmp-for-creation/` staging prefixes and bare `<ulid>/` prefixes left
+// without a meta.json, reclaiming uploads and purges that were interrupted before completing. Only prefixes whose
+// objects are all older than olderThan are removed, so an Upload still in flight is never raced.
+//
+// Meant to be called periodically from the compactor's maintenance loop; this tree has no compactor for it to be
+// wired into, so it is currently only exercised by its own tests.
+func CleanupPartialUploads(ctx context.Context, logger log.Logger, bkt objstore.Bucket, olderThan time.Duration) error {
+	// Non-recursive: this needs the folded top-level entries, not the flattened leaf keys WithRecursiveIter gives.
+	return bkt.Iter(ctx, "", func(name string) error {
+		dirName := strings.TrimSuffix(name, objstore.DirDelim)
+
+		if strings.HasSuffix(dirName, tmpForCreationSuffix) {
+			id, ok := IsBlockDir(strings.TrimSuffix(dirName, tmpForCreationSuffix))
+			if !ok {
+				return nil
+			}
+			return cleanupIfStale(ctx, logger, bkt, dirName, olderThan, id, "staging prefix")
+		}
+
+		id, ok := IsBlockDir(dirName)
+		if !ok {
+			return nil
+		}
+		hasMeta, err := bkt.Exists(ctx, path.Join(dirName, MetaFilename))
+		if err != nil {
+			return errors.Wrapf(err, "check meta.json for %s", dirName)
+		}
+		if hasMeta {
+			return nil
+		}
+		return cleanupIfStale(ctx, logger, bkt, dirName, olderThan, id, "incomplete block missing meta.json")
+	})
+}
+
+// cleanupIfStale purges dirName if every object under it is older than olderThan.
+func cleanupIfStale(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dirName string, olderThan time.Duration, id ulid.ULID, kind string) error {
+	stale, err := isOlderThan(ctx, bkt, dirName, olderThan)
+	if err != nil {
+		level.Warn(logger).Log("msg", "failed to determine age of leftover prefix; skipping", "block", id, "err", err)
+		return nil
+	}
+	if !stale {
+		return nil
+	}
+
+	if err := deletePrefix(ctx, bkt, dirName); err != nil {
+		return errors.Wrapf(err, "delete %s %s", kind, dirName)
+	}
+	level.Info(logger).Log("msg", fmt.Sprintf("removed stale %s", kind), "block", id)
+	return nil
+}
+
+// isOlderThan reports whether every object under prefix was last modified more than olderThan ago.
+func isOlderThan(ctx context.Context, bkt objstore.Bucket, prefix string, olderThan time.Duration) (bool, error) {
+	stale := true
+	err := bkt.Iter(ctx, prefix+"/", func(name string) error {
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			s, err := isOlderThan(ctx, bkt, strings.TrimSuffix(name, objstore.DirDelim), olderThan)
+			if err != nil {
+				return err
+			}
+			stale = stale && s
+			return nil
+		}
+
+		attrs, err := bkt.Attributes(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "attributes of %s", name)
+		}
+		if time.Since(attrs.LastModified) < olderThan {
+			stale = false
+		}
+		return nil
+	}, objstore.WithRecursiveIter)
+	return stale, err
+}
+
+// Delete removes a block in two stages: it is first renamed out of the way to a `<ulid>.tmp-for-deletion/` prefix
+// (or, where renaming would mean copying every chunk, marked in place with a deletion-in-progress file), then the
+// renamed/marked prefix is purged. RecoverInterruptedDeletions finishes the purge if the process dies in between.
+func Delete(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID) error {
+	toPurge, canonical, err := renameForDeletion(ctx, bkt, id)
+	if err != nil {
+		return errors.Wrap(err, "rename block for deletion")
+	}
+
+	if canonical {
+		err = deleteCanonicalPrefix(ctx, bkt, toPurge)
+	} else {
+		err = deletePrefix(ctx, bkt, toPurge)
+	}
+	if err != nil {
+		return errors.Wrap(err, "purge block")
+	}
+	level.Debug(logger).Log("msg", "deleted block", "block", id)
+	return nil
+}
+
+// renameForDeletion moves id's files out of their canonical prefix (on a copier bucket) or marks them in place with
+// a deletion-in-progress file (otherwise; meta.json and data then stay at the canonical prefix until purged), and
+// returns the prefix that now needs purging to actually reclaim the space, together with whether that prefix is
+// still the canonical, fetcher-visible one (true for the deletion-in-progress marker fallback, since it never moves anything) or an
+// already-unreachable copy (false, for the tmp-for-deletion prefix a server-side copy produced).
+func renameForDeletion(ctx context.Context, bkt objstore.Bucket, id ulid.ULID) (prefix string, canonical bool, err error) {
+	src := id.String()
+
+	if _, ok := bkt.(copier); !ok {
+		marker := path.Join(src, deletionInProgressMarkerFilename)
+		if err := bkt.Upload(ctx, marker, strings.NewReader(time.Now().UTC().Format(time.RFC3339))); err != nil {
+			return "", false, errors.Wrap(err, "upload deletion-in-progress marker")
+		}
+		return src, true, nil
+	}
+
+	dst := src + tmpForDeletionSuffix
+	if err := commitPrefix(ctx, bkt, src, dst); err != nil {
+		return "", false, errors.Wrap(err, "copy to tmp-for-deletion prefix")
+	}
+	// src is still the canonical prefix at this point: the copy above only added a second, non-canonical copy at
+	// dst, so purging src must still protect against a crash leaving a valid-looking meta.json with data missing.
+	if err := deleteCanonicalPrefix(ctx, bkt, src); err != nil {
+		return "", false, errors.Wrap(err, "delete canonical prefix after copy")
+	}
+	return dst, false, nil
+}
+
+// RecoverInterruptedDeletions finishes purges that Delete started but never completed.
+//
+// Meant to be called once at compactor/shipper startup; this tree has no compactor or shipper for it to be wired
+// into, so it is currently only exercised by its own tests.
+func RecoverInterruptedDeletions(ctx context.Context, logger log.Logger, bkt objstore.Bucket) error {
+	// Non-recursive: this needs the folded top-level entries, not the flattened leaf keys WithRecursiveIter gives.
+	return bkt.Iter(ctx, "", func(name string) error {
+		dirName := strings.TrimSuffix(name, objstore.DirDelim)
+
+		if strings.HasSuffix(dirName, tmpForDeletionSuffix) {
+			// Already copied away from the canonical prefix; purging this copy in any order is safe.
+			if err := deletePrefix(ctx, bkt, dirName); err != nil {
+				return errors.Wrapf(err, "purge renamed block %s", dirName)
+			}
+			level.Info(logger).Log("msg", "recovered block deletion interrupted after rename", "dir", dirName)
+			return nil
+		}
+
+		id, ok := IsBlockDir(dirName)
+		if !ok {
+			return nil
+		}
+		marked, err := bkt.Exists(ctx, path.Join(dirName, deletionInProgressMarkerFilename))
+		if err != nil {
+			return errors.Wrapf(err, "check deletion-in-progress marker for %s", dirName)
+		}
+		if !marked {
+			return nil
+		}
+		// dirName is still the canonical prefix here: meta.json must go first.
+		if err := deleteCanonicalPrefix(ctx, bkt, dirName); err != nil {
+			return errors.Wrapf(err, "purge marked block %s", dirName)
+		}
+		level.Info(logger).Log("msg", "recovered block deletion interrupted before purge", "block", id)
+		return nil
+	})
+}
+
+// MarkForDeletion creates a file which stores information about when the block was marked for deletion.
+func MarkForDeletion(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, markedForDeletion prometheus.Counter) error {
+	deletionMarkFile := path.Join(id.String(), metadata.DeletionMarkFilename)
+
+	exists, err := bkt.Exists(ctx, deletionMarkFile)
+	if err != nil {
+		return errors.Wrapf(err, "check if %s file exists in bucket", metadata.DeletionMarkFilename)
+	}
+	if exists {
+		level.Warn(logger).Log("msg", "requested to mark for deletion, but file already exists; this should not happen; investigate", "err", errors.Errorf("file %s already exists in bucket", deletionMarkFile))
+		return nil
+	}
+
+	deletionMark, err := json.Marshal(metadata.DeletionMark{
+		ID:           id,
+		DeletionTime: time.Now().Unix(),
+		Version:      metadata.DeletionMarkVersion1,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json encode deletion mark")
+	}
+
+	if err := bkt.Upload(ctx, deletionMarkFile, bytes.NewBuffer(deletionMark)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", deletionMarkFile)
+	}
+	markedForDeletion.Inc()
+	level.Info(logger).Log("msg", "block has been marked for deletion", "block", id)
+	return nil
+}
+
+// IsMetaCorrupt reports whether id's meta.json exists but is unusable: truncated or otherwise invalid JSON, or a
+// ulid that does not match id (e.g. a schema we don't understand, or the file belongs to a different block
+// entirely). A missing meta.json is not corruption — that is simply a block whose upload has not reached the
+// commit step yet — so callers get (false, nil) for it, same as for any other well-formed, non-corrupt block.
+func IsMetaCorrupt(ctx context.Context, bkt objstore.Bucket, id ulid.ULID) (bool, error) {
+	rc, err := bkt.Get(ctx, path.Join(id.String(), MetaFilename))
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "get meta.json")
+	}
+	defer rc.Close()
+
+	var m metadata.Meta
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return true, nil
+	}
+	return m.ULID.Compare(id) != 0, nil
+}
+
+// NewCorruptMetaCounter returns the thanos_bucket_blocks_corrupt_meta_total counter that QuarantineCorruptMeta
+// increments. It is defined here, next to the code that increments it, so that every caller shares one metric
+// definition rather than each registering its own copy under a slightly different name or help text.
+func NewCorruptMetaCounter(reg prometheus.Registerer) prometheus.Counter {
+	return promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_blocks_corrupt_meta_total",
+		Help: "Total number of blocks skipped during bucket sync because their meta.json could not be parsed.",
+	})
+}
+
+// QuarantineCorruptMeta checks id's meta.json with IsMetaCorrupt and, if it is corrupt, logs it, increments
+// corruptMetaCount (skipped if nil), and moves the block under a corrupt/<ulid>/ prefix for offline inspection.
+// It returns whether id was found corrupt, so a fetcher or bucket sync loop can skip the block for this cycle
+// instead of treating the corruption as fatal.
+func QuarantineCorruptMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, corruptMetaCount prometheus.Counter) (bool, error) {
+	corrupt, err := IsMetaCorrupt(ctx, bkt, id)
+	if err != nil {
+		return false, errors.Wrap(err, "check meta.json")
+	}
+	if !corrupt {
+		return false, nil
+	}
+
+	if corruptMetaCount != nil {
+		corruptMetaCount.Inc()
+	}
+	level.Warn(logger).Log("msg", "block has a corrupt meta.json, quarantining for inspection", "block", id)
+
+	dst := path.Join(CorruptMetaPrefix, id.String())
+	if err := commitPrefix(ctx, bkt, id.String(), dst); err != nil {
+		return true, errors.Wrap(err, "copy corrupt block to quarantine prefix")
+	}
+	if err := deletePrefix(ctx, bkt, id.String()); err != nil {
+		return true, errors.Wrap(err, "delete corrupt block from canonical prefix after quarantine")
+	}
+	return true, nil
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/testutil"
@@ -255,6 +256,92 @@ func TestDelete(t *testing.T) {
 		// Still 2 debug meta entries are expected.
 		testutil.Equals(t, 2, len(bkt.Objects()))
 	}
+	{
+		// Simulate a crash between the rename (here: writing the deletion-in-progress marker, since InMemBucket
+		// does not implement the copier interface) and purge steps of Delete, then recover at "startup".
+		b3, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+			{{Name: "a", Value: "1"}},
+			{{Name: "a", Value: "2"}},
+			{{Name: "a", Value: "3"}},
+			{{Name: "a", Value: "4"}},
+			{{Name: "b", Value: "1"}},
+		}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+		testutil.Ok(t, err)
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b3.String())))
+
+		_, _, err = renameForDeletion(ctx, bkt, b3)
+		testutil.Ok(t, err)
+		// Canonical files are still there; only the marker was added, simulating the crash before purge ran.
+		ok, err := bkt.Exists(ctx, path.Join(b3.String(), MetaFilename))
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "expected canonical files to still be present before recovery")
+
+		testutil.Ok(t, RecoverInterruptedDeletions(ctx, log.NewNopLogger(), bkt))
+		ok, err = bkt.Exists(ctx, path.Join(b3.String(), MetaFilename))
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok, "expected recovery to finish the interrupted deletion")
+		// Still 3 debug meta entries (b1, b2, b3) are expected.
+		testutil.Equals(t, 3, len(bkt.Objects()))
+	}
+}
+
+// recordingBucket wraps objstore.Bucket, records every name passed to Delete, and can simulate a crash by
+// failing the call right after failAfter successful deletes — so tests can pin down both deletion order and what
+// a process death mid-purge leaves behind, without needing a bucket implementation that actually crashes.
+type recordingBucket struct {
+	objstore.Bucket
+	deleted   *[]string
+	failAfter int
+}
+
+func (b recordingBucket) Delete(ctx context.Context, name string) error {
+	*b.deleted = append(*b.deleted, name)
+	if b.failAfter > 0 && len(*b.deleted) > b.failAfter {
+		return fmt.Errorf("simulated crash mid-purge")
+	}
+	return b.Bucket.Delete(ctx, name)
+}
+
+func TestDelete_MetaJSONDeletedFirstSoACrashMidPurgeNeverLeavesAValidLookingBlock(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-delete-order")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+		{{Name: "a", Value: "3"}},
+		{{Name: "a", Value: "4"}},
+		{{Name: "b", Value: "1"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+
+	inner := objstore.NewInMemBucket()
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), inner, path.Join(tmpDir, id.String())))
+
+	// Simulate a process dying after the first object (which must be meta.json) is deleted but before the rest
+	// of the purge runs.
+	var deleted []string
+	crashing := recordingBucket{inner, &deleted, 1}
+	testutil.NotOk(t, Delete(ctx, log.NewNopLogger(), crashing, id))
+	testutil.Equals(t, path.Join(id.String(), MetaFilename), deleted[0])
+
+	ok, err := inner.Exists(ctx, path.Join(id.String(), MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "meta.json must be gone after the simulated crash, even though the rest of the purge never ran")
+	ok, err = inner.Exists(ctx, path.Join(id.String(), IndexFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "non-meta files are expected to still be present right after the simulated crash")
+
+	// A retried Delete (the marker is already there; RecoverInterruptedDeletions would take the same path) must
+	// finish the job.
+	testutil.Ok(t, Delete(ctx, log.NewNopLogger(), inner, id))
+	ok, err = inner.Exists(ctx, path.Join(id.String(), IndexFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "expected a retried Delete to finish purging the leftover files")
 }
 
 func TestMarkForDeletion(t *testing.T) {
@@ -312,3 +399,306 @@ func TestMarkForDeletion(t *testing.T) {
 		})
 	}
 }
+
+func TestUpload_NonCopyCapableBucketUploadsDirectlyWithoutStaging(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-upload-no-staging")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	// objstore.NewInMemBucket does not implement copier, same as every real bucket backend today: Upload must not
+	// pay for a download-then-reupload round trip it gets no extra safety from.
+	bkt := objstore.NewInMemBucket()
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+
+	testutil.Equals(t, 4, len(bkt.Objects()))
+	for name := range bkt.Objects() {
+		testutil.Assert(t, !strings.Contains(name, id.String()+".tmp-for-creation"), "unexpected staging object on a non-copier bucket: %s", name)
+	}
+}
+
+func TestUpload_DoesNotLeaveStagingPrefixBehind(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-upload-staging")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := copyingBucket{objstore.NewInMemBucket()}
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+
+	for name := range bkt.Objects() {
+		testutil.Assert(t, !strings.Contains(name, id.String()+".tmp-for-creation"), "unexpected staging object left behind: %s", name)
+	}
+}
+
+func TestUpload_ResumesAfterInterruptedStagingUpload(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-upload-resume")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := copyingBucket{objstore.NewInMemBucket()}
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+
+	// Simulate a crash of a previous Upload call that managed to stage the chunks but never committed them.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String()+".tmp-for-creation", ChunksDirname, "000001"), bytes.NewReader([]byte("stale"))))
+
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+	testutil.Equals(t, 4, len(bkt.Objects()))
+	testutil.Assert(t, len(bkt.Objects()[path.Join(id.String(), ChunksDirname, "000001")]) != len("stale"), "stale staged chunk was not replaced by the resumed upload")
+
+	// Calling Upload again (e.g. a second resume after an already-successful commit) must be idempotent.
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+	testutil.Equals(t, 4, len(bkt.Objects()))
+}
+
+func TestIsMetaCorrupt(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-is-meta-corrupt")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+
+	{
+		// No meta.json uploaded at all yet: not corrupt, just not there.
+		corrupt, err := IsMetaCorrupt(ctx, bkt, id)
+		testutil.Ok(t, err)
+		testutil.Assert(t, !corrupt, "missing meta.json must not be reported as corrupt")
+	}
+
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+	{
+		corrupt, err := IsMetaCorrupt(ctx, bkt, id)
+		testutil.Ok(t, err)
+		testutil.Assert(t, !corrupt, "freshly uploaded meta.json must not be reported as corrupt")
+	}
+
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), MetaFilename), bytes.NewReader([]byte(`{"ulid": "`))))
+	{
+		corrupt, err := IsMetaCorrupt(ctx, bkt, id)
+		testutil.Ok(t, err)
+		testutil.Assert(t, corrupt, "truncated meta.json must be reported as corrupt")
+	}
+
+	mismatched, err := json.Marshal(metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil)}})
+	testutil.Ok(t, err)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), MetaFilename), bytes.NewReader(mismatched)))
+	{
+		corrupt, err := IsMetaCorrupt(ctx, bkt, id)
+		testutil.Ok(t, err)
+		testutil.Assert(t, corrupt, "meta.json with a mismatched ulid must be reported as corrupt")
+	}
+}
+
+func TestUpload_QuarantinesExistingCorruptMetaBeforeRetrying(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-upload-quarantines-corrupt-meta")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := copyingBucket{objstore.NewInMemBucket()}
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+
+	// Simulate a previous upload attempt for the same ID that left a truncated meta.json at the canonical prefix.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), MetaFilename), bytes.NewReader([]byte(`{"ulid": "`))))
+
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+
+	corrupt, err := IsMetaCorrupt(ctx, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !corrupt, "the retried upload must have replaced the corrupt meta.json with a valid one")
+
+	quarantined, err := bkt.Get(ctx, path.Join(CorruptMetaPrefix, id.String(), MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Ok(t, quarantined.Close())
+}
+
+// copyingBucket wraps objstore.Bucket and adds a Copy method, purely so tests can exercise the server-side-copy
+// branch of commitPrefix/QuarantineCorruptMeta without needing a real bucket implementation that supports it.
+type copyingBucket struct {
+	objstore.Bucket
+}
+
+func (b copyingBucket) Copy(ctx context.Context, src, dst string) error {
+	rc, err := b.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return b.Upload(ctx, dst, rc)
+}
+
+func TestQuarantineCorruptMeta_MovesBlockOnCopyCapableBucket(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-quarantine-corrupt-meta-copy")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := copyingBucket{objstore.NewInMemBucket()}
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), MetaFilename), bytes.NewReader([]byte("not json"))))
+
+	c := NewCorruptMetaCounter(nil)
+	corrupt, err := QuarantineCorruptMeta(ctx, log.NewNopLogger(), bkt, id, c)
+	testutil.Ok(t, err)
+	testutil.Assert(t, corrupt, "expected meta.json to be reported corrupt")
+	testutil.Equals(t, float64(1), promtest.ToFloat64(c))
+
+	ok, err := bkt.Exists(ctx, path.Join(id.String(), MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "expected corrupt block to be removed from its canonical prefix")
+
+	quarantined, err := bkt.Get(ctx, path.Join(CorruptMetaPrefix, id.String(), MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Ok(t, quarantined.Close())
+}
+
+func TestQuarantineCorruptMeta(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-quarantine-corrupt-meta")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), MetaFilename), bytes.NewReader([]byte("not json"))))
+
+	c := NewCorruptMetaCounter(nil)
+
+	// A bucket sync loop must be able to continue past a corrupt block rather than aborting.
+	corrupt, err := QuarantineCorruptMeta(ctx, log.NewNopLogger(), bkt, id, c)
+	testutil.Ok(t, err)
+	testutil.Assert(t, corrupt, "expected meta.json to be reported corrupt")
+	testutil.Equals(t, float64(1), promtest.ToFloat64(c))
+
+	// The block must actually be moved out of the canonical prefix, even on a bucket that can't copy
+	// server-side: quarantining has to work on every real backend, not just copier-capable ones.
+	ok, err := bkt.Exists(ctx, path.Join(id.String(), MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "expected corrupt block to be removed from its canonical prefix")
+	quarantined, err := bkt.Get(ctx, path.Join(CorruptMetaPrefix, id.String(), MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Ok(t, quarantined.Close())
+
+	// A second, healthy block must not affect the counter or be mistaken for corrupt.
+	okID, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, okID.String())))
+	corrupt, err = QuarantineCorruptMeta(ctx, log.NewNopLogger(), bkt, okID, c)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !corrupt, "expected healthy block not to be reported corrupt")
+	testutil.Equals(t, float64(1), promtest.ToFloat64(c))
+}
+
+func TestCleanupPartialUploads(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	bkt := objstore.NewInMemBucket()
+	id := ulid.MustNew(1, nil)
+	stagingChunk := path.Join(id.String()+".tmp-for-creation", ChunksDirname, "000001")
+	testutil.Ok(t, bkt.Upload(ctx, stagingChunk, bytes.NewReader([]byte("partial"))))
+
+	// A staging prefix younger than olderThan must be left alone: the Upload that produced it might still be
+	// running.
+	testutil.Ok(t, CleanupPartialUploads(ctx, log.NewNopLogger(), bkt, 24*time.Hour))
+	_, err := bkt.Get(ctx, stagingChunk)
+	testutil.Ok(t, err)
+
+	// Once it is older than olderThan, it gets removed.
+	testutil.Ok(t, CleanupPartialUploads(ctx, log.NewNopLogger(), bkt, -time.Hour))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+}
+
+func TestCleanupPartialUploads_ReclaimsBareBlockDirMissingMeta(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	bkt := objstore.NewInMemBucket()
+	id := ulid.MustNew(1, nil)
+	// A direct-to-canonical Upload (non-copier bucket) that crashed after chunks landed but before meta.json did,
+	// or a copier-backend Delete that crashed right after removing meta.json, leave exactly this: a bare <ulid>/
+	// prefix with data files but no meta.json.
+	orphanChunk := path.Join(id.String(), ChunksDirname, "000001")
+	testutil.Ok(t, bkt.Upload(ctx, orphanChunk, bytes.NewReader([]byte("orphan"))))
+
+	testutil.Ok(t, CleanupPartialUploads(ctx, log.NewNopLogger(), bkt, 24*time.Hour))
+	_, err := bkt.Get(ctx, orphanChunk)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, CleanupPartialUploads(ctx, log.NewNopLogger(), bkt, -time.Hour))
+	testutil.Equals(t, 0, len(bkt.Objects()))
+}
+
+func TestCleanupPartialUploads_LeavesCompleteBlockAlone(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-cleanup-leaves-complete-block")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+
+	testutil.Ok(t, CleanupPartialUploads(ctx, log.NewNopLogger(), bkt, -time.Hour))
+	testutil.Equals(t, 4, len(bkt.Objects()))
+}